@@ -0,0 +1,134 @@
+// Package content provides pluggable file-payload generators for
+// randfiles, selected via the -content flag.
+package content
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Generator fills a buffer with file payload bytes.
+type Generator interface {
+	Fill(buf []byte)
+}
+
+// Parse builds a Generator from a -content flag value, such as "crand",
+// "mrand", "zero", "text", "repeat:aabbcc", or "compressible:0.5".
+func Parse(spec string) (Generator, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	switch name {
+	case "", "crand":
+		return cryptoRand{}, nil
+	case "mrand":
+		return newMathRand(), nil
+	case "zero":
+		return zero{}, nil
+	case "text":
+		return text{}, nil
+	case "repeat":
+		pattern, err := hex.DecodeString(arg)
+		if err != nil {
+			return nil, fmt.Errorf("content: bad repeat pattern %q: %v", arg, err)
+		}
+		if len(pattern) == 0 {
+			return nil, fmt.Errorf("content: repeat pattern must not be empty")
+		}
+		return repeat{pattern: pattern}, nil
+	case "compressible":
+		ratio, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return nil, fmt.Errorf("content: bad compressible ratio %q: %v", arg, err)
+		}
+		return compressible{ratio: ratio}, nil
+	default:
+		return nil, fmt.Errorf("content: unknown generator %q", name)
+	}
+}
+
+// cryptoRand fills buffers from crypto/rand, the slow but incompressible
+// default.
+type cryptoRand struct{}
+
+func (cryptoRand) Fill(buf []byte) {
+	_, err := crand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// mathRand fills buffers from math/rand, seeded once from crypto/rand so
+// each generator instance still varies across threads, but far faster
+// than crypto/rand for bulk generation.
+type mathRand struct {
+	rnd *rand.Rand
+}
+
+func newMathRand() *mathRand {
+	var seed int64
+	b := make([]byte, 8)
+	_, err := crand.Read(b)
+	if err == nil {
+		for i, v := range b {
+			seed |= int64(v) << uint(8*i)
+		}
+	}
+	return &mathRand{rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (m *mathRand) Fill(buf []byte) {
+	m.rnd.Read(buf)
+}
+
+// zero fills buffers with all-zero bytes, a maximally compressible
+// payload.
+type zero struct{}
+
+func (zero) Fill(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+const textChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789 .,\n"
+
+// text fills buffers with printable ASCII.
+type text struct{}
+
+func (text) Fill(buf []byte) {
+	for i := range buf {
+		buf[i] = textChars[rand.Intn(len(textChars))]
+	}
+}
+
+// repeat fills buffers by tiling a fixed byte pattern, useful for making
+// files identifiable by downstream tools.
+type repeat struct {
+	pattern []byte
+}
+
+func (r repeat) Fill(buf []byte) {
+	for i := range buf {
+		buf[i] = r.pattern[i%len(r.pattern)]
+	}
+}
+
+// compressible fills buffers with random bytes, then zeroes a fraction
+// of them to hit an approximate target compression ratio.
+type compressible struct {
+	ratio float64
+}
+
+func (c compressible) Fill(buf []byte) {
+	_, err := crand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	zeros := int(float64(len(buf)) * c.ratio)
+	for i := 0; i < zeros; i++ {
+		buf[rand.Intn(len(buf))] = 0
+	}
+}
@@ -0,0 +1,122 @@
+package content
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDefaultsToCryptoRand(t *testing.T) {
+	for _, spec := range []string{"", "crand"} {
+		g, err := Parse(spec)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", spec, err)
+		}
+		if _, ok := g.(cryptoRand); !ok {
+			t.Fatalf("Parse(%q) = %T, want cryptoRand", spec, g)
+		}
+	}
+}
+
+func TestParseMrand(t *testing.T) {
+	g, err := Parse("mrand")
+	if err != nil {
+		t.Fatalf("Parse(\"mrand\"): %v", err)
+	}
+	if _, ok := g.(*mathRand); !ok {
+		t.Fatalf("Parse(\"mrand\") = %T, want *mathRand", g)
+	}
+}
+
+func TestParseRepeatRoundTrip(t *testing.T) {
+	g, err := Parse("repeat:aabbcc")
+	if err != nil {
+		t.Fatalf("Parse(\"repeat:aabbcc\"): %v", err)
+	}
+	buf := make([]byte, 9)
+	g.Fill(buf)
+	want := "\xaa\xbb\xcc\xaa\xbb\xcc\xaa\xbb\xcc"
+	if string(buf) != want {
+		t.Fatalf("Fill = %x, want %x", buf, want)
+	}
+}
+
+func TestParseRepeatErrors(t *testing.T) {
+	if _, err := Parse("repeat:zz"); err == nil {
+		t.Fatal("Parse(\"repeat:zz\") with bad hex: want error, got nil")
+	}
+	if _, err := Parse("repeat:"); err == nil {
+		t.Fatal("Parse(\"repeat:\") with empty pattern: want error, got nil")
+	}
+}
+
+func TestParseCompressibleRoundTrip(t *testing.T) {
+	g, err := Parse("compressible:0.5")
+	if err != nil {
+		t.Fatalf("Parse(\"compressible:0.5\"): %v", err)
+	}
+	c, ok := g.(compressible)
+	if !ok {
+		t.Fatalf("Parse(\"compressible:0.5\") = %T, want compressible", g)
+	}
+	if c.ratio != 0.5 {
+		t.Fatalf("ratio = %v, want 0.5", c.ratio)
+	}
+}
+
+func TestParseCompressibleError(t *testing.T) {
+	if _, err := Parse("compressible:notafloat"); err == nil {
+		t.Fatal("Parse(\"compressible:notafloat\"): want error, got nil")
+	}
+}
+
+func TestParseUnknownGenerator(t *testing.T) {
+	if _, err := Parse("bogus"); err == nil {
+		t.Fatal("Parse(\"bogus\"): want error, got nil")
+	}
+}
+
+// TestGeneratorsFillWholeBuffer runs every generator's Fill over a buffer
+// pre-seeded with a 0xff sentinel. For zero, repeat, and text it checks
+// every byte by value, which also shows no byte was left untouched; for
+// crand, mrand, and compressible, whose output is random, it only checks
+// that Fill runs without panicking.
+func TestGeneratorsFillWholeBuffer(t *testing.T) {
+	generators := []struct {
+		name string
+		gen  Generator
+	}{
+		{"crand", cryptoRand{}},
+		{"mrand", newMathRand()},
+		{"zero", zero{}},
+		{"text", text{}},
+		{"repeat", repeat{pattern: []byte{0x42}}},
+		{"compressible", compressible{ratio: 0.5}},
+	}
+	for _, tc := range generators {
+		buf := make([]byte, 256)
+		for i := range buf {
+			buf[i] = 0xff
+		}
+		tc.gen.Fill(buf)
+		switch tc.name {
+		case "zero":
+			for i, b := range buf {
+				if b != 0 {
+					t.Fatalf("zero.Fill: buf[%d] = %#x, want 0", i, b)
+				}
+			}
+		case "repeat":
+			for i, b := range buf {
+				if b != 0x42 {
+					t.Fatalf("repeat.Fill: buf[%d] = %#x, want 0x42", i, b)
+				}
+			}
+		case "text":
+			for i, b := range buf {
+				if !strings.ContainsRune(textChars, rune(b)) {
+					t.Fatalf("text.Fill: buf[%d] = %q not in textChars", i, b)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+
+	"github.com/ancientlore/kubismus"
+)
+
+// fileInfo tracks one currently-live generated file.
+type fileInfo struct {
+	name   string
+	size   int64
+	pinned bool // mid-rewrite; must not be picked as an eviction victim
+}
+
+// Population tracks the set of files this process has created so the
+// working set can be capped at -maxfiles/-maxbytes, evicting via
+// -churn once a cap is exceeded.
+type Population struct {
+	policy   string
+	maxFiles int
+	maxBytes int64
+
+	mu      sync.Mutex
+	order   *list.List // ordered by insertion/access, for fifo & lru
+	entries map[string]*list.Element
+	bytes   int64
+	seen    int64 // total files ever added, for reservoir sampling
+}
+
+// NewPopulation creates a Population enforcing the given caps via the
+// named churn policy (fifo, lru, random, or reservoir). A cap of 0
+// disables that particular limit. The policy is validated up front so a
+// typo like "resevoir" fails fast at startup instead of silently falling
+// back to fifo eviction.
+func NewPopulation(policy string, maxFiles int, maxBytes int64) (*Population, error) {
+	switch policy {
+	case "fifo", "lru", "random", "reservoir":
+	default:
+		return nil, fmt.Errorf("population: unknown churn policy %q", policy)
+	}
+	return &Population{
+		policy:   policy,
+		maxFiles: maxFiles,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}, nil
+}
+
+// Add registers a newly created file and evicts victims, per the churn
+// policy, until the population is back under the configured caps.
+func (p *Population) Add(name string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	el := p.order.PushBack(&fileInfo{name: name, size: size})
+	p.entries[name] = el
+	p.bytes += size
+	p.seen++
+
+	if p.policy == "reservoir" && p.maxFiles > 0 && p.order.Len() > p.maxFiles {
+		p.reservoirTrimLocked(el)
+	}
+
+	for p.overLocked() {
+		if !p.evictLocked() {
+			// Every remaining file is pinned for an in-flight rewrite;
+			// stop rather than spin. The next Add will retry.
+			break
+		}
+	}
+}
+
+// Touch records access to name, which only matters to the lru policy.
+func (p *Population) Touch(name string) {
+	if p.policy != "lru" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el, ok := p.entries[name]; ok {
+		p.order.MoveToBack(el)
+	}
+}
+
+// PinRandom returns the name of a currently-live file, pinned against
+// eviction until the caller releases it via Unpin, or ok=false if the
+// population is empty or the file picked is already pinned.
+//
+// Pinning closes a TOCTOU race: without it, selecting a rewrite victim
+// and opening it for write happen under separate locks, so a concurrent
+// Add on another writer thread can evict (and os.Remove) that exact file
+// in the gap, especially once -fps/-bps pacing widens the window between
+// selection and open. A pinned entry is skipped by evictLocked and
+// reservoirTrimLocked, so it can't disappear out from under the caller.
+func (p *Population) PinRandom() (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.entries) == 0 {
+		return "", false
+	}
+	n := rand.Intn(len(p.entries))
+	for name, el := range p.entries {
+		if n == 0 {
+			fi := el.Value.(*fileInfo)
+			if fi.pinned {
+				return "", false
+			}
+			fi.pinned = true
+			return name, true
+		}
+		n--
+	}
+	return "", false
+}
+
+// Unpin releases the eviction pin set by PinRandom, making name eligible
+// for eviction again.
+func (p *Population) Unpin(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el, ok := p.entries[name]; ok {
+		el.Value.(*fileInfo).pinned = false
+	}
+}
+
+// Resize updates the recorded size of name after a rewrite.
+func (p *Population) Resize(name string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el, ok := p.entries[name]; ok {
+		fi := el.Value.(*fileInfo)
+		p.bytes += size - fi.size
+		fi.size = size
+	}
+}
+
+func (p *Population) overLocked() bool {
+	if p.maxFiles > 0 && p.order.Len() > p.maxFiles {
+		return true
+	}
+	if p.maxBytes > 0 && p.bytes > p.maxBytes {
+		return true
+	}
+	return false
+}
+
+// evictLocked removes one eligible file according to the churn policy
+// and reports whether it found one to remove. It returns false if every
+// file is currently pinned for an in-flight rewrite (the caller should
+// stop rather than spin; the next Add will retry). Caller must hold p.mu.
+func (p *Population) evictLocked() bool {
+	var el *list.Element
+	switch p.policy {
+	case "random", "reservoir":
+		el = p.randomUnpinnedLocked()
+	default: // "fifo", "lru"
+		el = p.firstUnpinnedLocked()
+	}
+	if el == nil {
+		return false
+	}
+	p.removeLocked(el)
+	return true
+}
+
+// firstUnpinnedLocked returns the oldest element that isn't pinned for an
+// in-flight rewrite, or nil if every element is pinned. Caller must hold
+// p.mu.
+func (p *Population) firstUnpinnedLocked() *list.Element {
+	for el := p.order.Front(); el != nil; el = el.Next() {
+		if !el.Value.(*fileInfo).pinned {
+			return el
+		}
+	}
+	return nil
+}
+
+// randomUnpinnedLocked returns a uniformly chosen element among those not
+// pinned for an in-flight rewrite, or nil if every element is pinned.
+// Caller must hold p.mu.
+func (p *Population) randomUnpinnedLocked() *list.Element {
+	var eligible []*list.Element
+	for el := p.order.Front(); el != nil; el = el.Next() {
+		if !el.Value.(*fileInfo).pinned {
+			eligible = append(eligible, el)
+		}
+	}
+	if len(eligible) == 0 {
+		return nil
+	}
+	return eligible[rand.Intn(len(eligible))]
+}
+
+// reservoirTrimLocked applies classic reservoir sampling (algorithm R) so
+// the file-count population stays a uniform random sample of every file
+// ever created, rather than always evicting an old file to make room for
+// the new one. newEl is the element just pushed onto the back of p.order
+// as the p.seen-th file created; it survives with probability
+// maxFiles/p.seen, replacing a uniformly chosen existing file, and is
+// otherwise discarded itself. Caller must hold p.mu.
+//
+// If the chosen victim happens to be pinned for an in-flight rewrite, it
+// is left in place rather than evicted out from under the rewrite; the
+// population is temporarily left one over cap, and the overLocked loop
+// in Add falls back to evictLocked's random-among-unpinned eviction to
+// bring it back down.
+func (p *Population) reservoirTrimLocked(newEl *list.Element) {
+	j := rand.Int63n(p.seen)
+	if int(j) < p.maxFiles {
+		if victim := p.nthLocked(int(j)); victim != nil && !victim.Value.(*fileInfo).pinned {
+			p.removeLocked(victim)
+		}
+		return
+	}
+	p.removeLocked(newEl)
+}
+
+// nthLocked returns the nth (0-indexed) element in insertion order, or nil
+// if n is out of range. Caller must hold p.mu.
+func (p *Population) nthLocked(n int) *list.Element {
+	el := p.order.Front()
+	for ; n > 0 && el != nil; n-- {
+		el = el.Next()
+	}
+	return el
+}
+
+// removeLocked deletes el from the population and the filesystem. Caller
+// must hold p.mu.
+func (p *Population) removeLocked(el *list.Element) {
+	fi := el.Value.(*fileInfo)
+	p.order.Remove(el)
+	delete(p.entries, fi.name)
+	p.bytes -= fi.size
+
+	err := os.Remove(fi.name)
+	if err != nil {
+		log.Print(err)
+	} else {
+		kubismus.Metric("Files deleted", 1, float64(fi.size))
+	}
+}
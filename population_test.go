@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// touchFile creates an empty file at path so Population.removeLocked's
+// os.Remove has something real to delete.
+func touchFile(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("os.Create(%q): %v", path, err)
+	}
+	f.Close()
+}
+
+func TestNewPopulationUnknownPolicy(t *testing.T) {
+	if _, err := NewPopulation("resevoir", 1, 0); err == nil {
+		t.Fatal("NewPopulation with unknown policy: want error, got nil")
+	}
+}
+
+func TestPopulationFIFOEviction(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewPopulation("fifo", 2, 0)
+	if err != nil {
+		t.Fatalf("NewPopulation: %v", err)
+	}
+
+	names := []string{"a", "b", "c"}
+	for _, n := range names {
+		path := filepath.Join(dir, n)
+		touchFile(t, path)
+		p.Add(path, 10)
+	}
+
+	// Capacity is 2, so the oldest file ("a") should have been evicted.
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be evicted (fifo), stat err = %v", "a", err)
+	}
+	for _, n := range []string{"b", "c"} {
+		if _, err := os.Stat(filepath.Join(dir, n)); err != nil {
+			t.Errorf("expected %q to survive, stat err = %v", n, err)
+		}
+	}
+}
+
+func TestPopulationLRUEviction(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewPopulation("lru", 2, 0)
+	if err != nil {
+		t.Fatalf("NewPopulation: %v", err)
+	}
+
+	pathA := filepath.Join(dir, "a")
+	pathB := filepath.Join(dir, "b")
+	pathC := filepath.Join(dir, "c")
+	touchFile(t, pathA)
+	touchFile(t, pathB)
+	p.Add(pathA, 10)
+	p.Add(pathB, 10)
+
+	// Touching "a" makes "b" the least-recently-used entry, so adding a
+	// third file should evict "b" instead of "a".
+	p.Touch(pathA)
+	touchFile(t, pathC)
+	p.Add(pathC, 10)
+
+	if _, err := os.Stat(pathB); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be evicted (lru), stat err = %v", "b", err)
+	}
+	if _, err := os.Stat(pathA); err != nil {
+		t.Errorf("expected %q to survive (touched), stat err = %v", "a", err)
+	}
+}
+
+func TestPopulationMaxBytesEviction(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewPopulation("fifo", 0, 25)
+	if err != nil {
+		t.Fatalf("NewPopulation: %v", err)
+	}
+
+	for _, n := range []string{"a", "b", "c"} {
+		path := filepath.Join(dir, n)
+		touchFile(t, path)
+		p.Add(path, 10)
+	}
+
+	// Cap is 25 bytes; three 10-byte files exceed it, so the oldest must go.
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be evicted (maxbytes), stat err = %v", "a", err)
+	}
+}
+
+func TestPopulationReservoirKeepsConfiguredSize(t *testing.T) {
+	dir := t.TempDir()
+	const maxFiles = 5
+	p, err := NewPopulation("reservoir", maxFiles, 0)
+	if err != nil {
+		t.Fatalf("NewPopulation: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		path := filepath.Join(dir, "f"+strconv.Itoa(i))
+		touchFile(t, path)
+		p.Add(path, 1)
+	}
+
+	p.mu.Lock()
+	got := p.order.Len()
+	p.mu.Unlock()
+	if got != maxFiles {
+		t.Fatalf("reservoir population size = %d, want %d", got, maxFiles)
+	}
+}
+
+func TestPopulationPinRandomSurvivesEviction(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewPopulation("fifo", 1, 0)
+	if err != nil {
+		t.Fatalf("NewPopulation: %v", err)
+	}
+
+	pathA := filepath.Join(dir, "a")
+	touchFile(t, pathA)
+	p.Add(pathA, 10)
+
+	name, ok := p.PinRandom()
+	if !ok || name != pathA {
+		t.Fatalf("PinRandom() = (%q, %v), want (%q, true)", name, ok, pathA)
+	}
+
+	// With maxFiles=1, adding a second file would normally evict "a" as
+	// the oldest entry - but it's pinned, so it must survive and the new
+	// file should be evicted instead since it's the only unpinned one.
+	pathB := filepath.Join(dir, "b")
+	touchFile(t, pathB)
+	p.Add(pathB, 10)
+
+	if _, err := os.Stat(pathA); err != nil {
+		t.Errorf("expected pinned %q to survive eviction, stat err = %v", "a", err)
+	}
+	if _, err := os.Stat(pathB); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be evicted instead of the pinned file, stat err = %v", "b", err)
+	}
+
+	p.Unpin(pathA)
+	p.mu.Lock()
+	pinned := p.entries[pathA].Value.(*fileInfo).pinned
+	p.mu.Unlock()
+	if pinned {
+		t.Fatal("expected Unpin to clear the pin")
+	}
+}
+
+func TestPopulationPinRandomAlreadyPinned(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewPopulation("fifo", 0, 0)
+	if err != nil {
+		t.Fatalf("NewPopulation: %v", err)
+	}
+	path := filepath.Join(dir, "a")
+	touchFile(t, path)
+	p.Add(path, 10)
+
+	if _, ok := p.PinRandom(); !ok {
+		t.Fatal("first PinRandom: want ok=true")
+	}
+	if _, ok := p.PinRandom(); ok {
+		t.Fatal("second PinRandom on an already-pinned, only entry: want ok=false")
+	}
+}
+
+func TestPopulationResize(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewPopulation("fifo", 0, 0)
+	if err != nil {
+		t.Fatalf("NewPopulation: %v", err)
+	}
+	path := filepath.Join(dir, "a")
+	touchFile(t, path)
+	p.Add(path, 10)
+	p.Resize(path, 20)
+
+	p.mu.Lock()
+	bytes := p.bytes
+	p.mu.Unlock()
+	if bytes != 20 {
+		t.Fatalf("bytes after resize = %d, want %d", bytes, 20)
+	}
+}
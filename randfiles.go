@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"github.com/ancientlore/flagcfg"
 	"github.com/ancientlore/kubismus"
+	"github.com/ancientlore/randfiles/content"
 	"github.com/facebookgo/flagenv"
+	"golang.org/x/time/rate"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -26,6 +34,31 @@ var (
 	delay      time.Duration = 100 * time.Millisecond
 	ext        string        = ".bin"
 	help       bool
+
+	layout   *Layout
+	fileMeta metadataStats
+
+	modeMask     string        = "0"
+	modeMin      string        = "0400"
+	mtimeSpread  time.Duration = 0
+	preserveTime bool
+
+	treeDepth     int    = 0
+	treeFanout    int    = 16
+	treeMaxPerDir int    = 0
+	treeMode      string = "flat"
+
+	maxFiles     int     = 0
+	maxBytes     int64   = 0
+	churn        string  = "fifo"
+	rewriteRatio float64 = 0
+
+	contentSpec string = "crand"
+	header      string = ""
+	footer      string = ""
+
+	fps float64 = 0
+	bps float64 = 0
 )
 
 func init() {
@@ -43,6 +76,33 @@ func init() {
 	flag.IntVar(&maxSize, "maxsize", maxSize, "Maximum file size.")
 	flag.StringVar(&ext, "ext", ext, "File extension.")
 
+	// file metadata randomization
+	flag.StringVar(&modeMask, "modemask", modeMask, "Octal mask of mode bits to randomize per file (0 disables mode randomization).")
+	flag.StringVar(&modeMin, "modemin", modeMin, "Octal mode bits always set on files whose mode is randomized via -modemask, e.g. mandatory read bits.")
+	flag.DurationVar(&mtimeSpread, "mtimespread", mtimeSpread, "Randomize mtime to a random point up to this far in the past (0 disables).")
+	flag.BoolVar(&preserveTime, "preservetime", preserveTime, "Preserve the actual access time instead of randomizing it along with mtime.")
+
+	// directory tree layout
+	flag.IntVar(&treeDepth, "treedepth", treeDepth, "Number of subdirectory levels in \"random\" and \"hashed\" tree modes (0 places files flat; \"date\" mode always uses four levels).")
+	flag.IntVar(&treeFanout, "treefanout", treeFanout, "Number of subdirectories per level in \"random\" tree mode.")
+	flag.IntVar(&treeMaxPerDir, "treemaxperdir", treeMaxPerDir, "Rebalance to a fresh sibling directory once a directory holds this many files (0 disables).")
+	flag.StringVar(&treeMode, "treemode", treeMode, "Directory layout: flat, random, hashed, or date.")
+
+	// steady-state churn
+	flag.IntVar(&maxFiles, "maxfiles", maxFiles, "Cap the working set to this many files, evicting via -churn (0 disables).")
+	flag.Int64Var(&maxBytes, "maxbytes", maxBytes, "Cap the working set to this many bytes, evicting via -churn (0 disables).")
+	flag.StringVar(&churn, "churn", churn, "Eviction policy once a cap is hit: fifo, lru, random, or reservoir.")
+	flag.Float64Var(&rewriteRatio, "rewriteratio", rewriteRatio, "Fraction of iterations (0.0-1.0) that rewrite an existing file instead of creating a new one.")
+
+	// content generation
+	flag.StringVar(&contentSpec, "content", contentSpec, "Content generator: crand, mrand, zero, text, repeat:<hexpattern>, or compressible:<ratio>.")
+	flag.StringVar(&header, "header", header, "Hex bytes to prepend to every generated file.")
+	flag.StringVar(&footer, "footer", footer, "Hex bytes to append to every generated file.")
+
+	// rate limiting
+	flag.Float64Var(&fps, "fps", fps, "Aggregate files/second across all threads (0 derives a rate from -delay and -threads).")
+	flag.Float64Var(&bps, "bps", bps, "Aggregate bytes/second across all threads (0 disables byte-rate limiting).")
+
 	// help
 	flag.BoolVar(&help, "help", false, "Show help.")
 }
@@ -101,6 +161,82 @@ func main() {
 	kubismus.Define("Data", kubismus.COUNT, "Files/second")
 	kubismus.Define("Data", kubismus.SUM, "Bytes/second")
 
+	modeMaskVal, err := strconv.ParseUint(modeMask, 8, 32)
+	if err != nil {
+		log.Fatalf("invalid -modemask %q: %v", modeMask, err)
+	}
+	modeMinVal, err := strconv.ParseUint(modeMin, 8, 32)
+	if err != nil {
+		log.Fatalf("invalid -modemin %q: %v", modeMin, err)
+	}
+	if modeMaskVal != 0 {
+		kubismus.Note("Mode randomization", fmt.Sprintf("mask %#o, min %#o", modeMaskVal, modeMinVal))
+	}
+	if mtimeSpread < 0 {
+		log.Fatalf("invalid -mtimespread %q: must not be negative", mtimeSpread)
+	}
+	if mtimeSpread != 0 {
+		kubismus.Note("Mtime spread", fmt.Sprintf("%s (preserve atime: %t)", mtimeSpread, preserveTime))
+	}
+
+	layout, err = NewLayout(treeMode, treeDepth, treeFanout, treeMaxPerDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	kubismus.Note("Tree layout", fmt.Sprintf("mode %s, depth %d, fanout %d, maxperdir %d", treeMode, treeDepth, treeFanout, treeMaxPerDir))
+
+	var population *Population
+	if maxFiles > 0 || maxBytes > 0 || rewriteRatio > 0 {
+		// An uncapped Population (maxFiles == maxBytes == 0) still tracks
+		// live files so -rewriteratio has something to pick a victim from,
+		// even when the user didn't ask for working-set eviction.
+		population, err = NewPopulation(churn, maxFiles, maxBytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		kubismus.Note("Churn", fmt.Sprintf("policy %s, maxfiles %d, maxbytes %d, rewriteratio %.2f", churn, maxFiles, maxBytes, rewriteRatio))
+	}
+	kubismus.Define("Files created", kubismus.COUNT, "Files/second")
+	kubismus.Define("Files deleted", kubismus.COUNT, "Files/second")
+	kubismus.Define("Files deleted", kubismus.SUM, "Bytes/second")
+	kubismus.Define("Rewrites", kubismus.COUNT, "Files/second")
+
+	// Validate the spec up front so a typo fails fast; each writer thread
+	// builds its own Generator instance below, since stateful generators
+	// like mrand wrap a *rand.Rand that isn't safe for concurrent use.
+	_, err = content.Parse(contentSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	kubismus.Note("Content generator", contentSpec)
+
+	headerBytes, err := hex.DecodeString(header)
+	if err != nil {
+		log.Fatalf("invalid -header %q: %v", header, err)
+	}
+	footerBytes, err := hex.DecodeString(footer)
+	if err != nil {
+		log.Fatalf("invalid -footer %q: %v", footer, err)
+	}
+	if len(headerBytes) > 0 || len(footerBytes) > 0 {
+		kubismus.Note("Header/footer", fmt.Sprintf("%d/%d bytes", len(headerBytes), len(footerBytes)))
+	}
+
+	effectiveFPS := fps
+	if effectiveFPS == 0 && delay > 0 {
+		effectiveFPS = float64(threads) / delay.Seconds()
+	}
+	filesLim := rate.NewLimiter(rate.Inf, 1)
+	if effectiveFPS > 0 {
+		filesLim = rate.NewLimiter(rate.Limit(effectiveFPS), 1)
+	}
+	bytesLim := rate.NewLimiter(rate.Inf, 1)
+	if bps > 0 {
+		bytesLim = rate.NewLimiter(rate.Limit(bps), maxSize+len(headerBytes)+len(footerBytes))
+	}
+	kubismus.Note("Rate limits", fmt.Sprintf("%.2f files/sec, %.0f bytes/sec (0 = unlimited)", effectiveFPS, bps))
+	kubismus.Define("Overruns", kubismus.COUNT, "Events/second")
+
 	// switch to working dir
 	if workingDir != "" {
 		err := os.Chdir(workingDir)
@@ -113,39 +249,97 @@ func main() {
 		kubismus.Note("Working Directory", wd)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		log.Print("Shutting down...")
+		cancel()
+	}()
+
 	rand.Seed(time.Now().UnixNano())
+	var wg sync.WaitGroup
 	for i := 0; i < threads; i++ {
-		go writeFiles(minSize, maxSize, delay, ext)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gen, err := content.Parse(contentSpec)
+			if err != nil {
+				log.Fatal(err)
+			}
+			writeFiles(ctx, minSize, maxSize, ext, os.FileMode(modeMaskVal), os.FileMode(modeMinVal), mtimeSpread, preserveTime, layout, population, rewriteRatio, gen, headerBytes, footerBytes, filesLim, bytesLim)
+		}()
 	}
-	go calcMetrics()
+	go calcMetrics(ctx)
+
+	srv := &http.Server{Addr: addr}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Print(err)
+		}
+	}()
 
-	log.Fatal(http.ListenAndServe(addr, nil))
+	<-ctx.Done()
+	wg.Wait()
+	srv.Shutdown(context.Background())
+	reportMetrics()
 }
 
-func writeFiles(mn, mx int, delay time.Duration, extension string) {
+func writeFiles(ctx context.Context, mn, mx int, extension string, modeMask, modeMin os.FileMode, mtimeSpread time.Duration, preserveTime bool, layout *Layout, population *Population, rewriteRatio float64, gen content.Generator, header, footer []byte, filesLim, bytesLim *rate.Limiter) {
 	b := make([]byte, mx)
 	fn := make([]byte, 16)
 	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if population != nil && rewriteRatio > 0 && rand.Float64() < rewriteRatio {
+			if name, ok := population.PinRandom(); ok {
+				sz := mn + rand.Intn(mx-mn)
+				total := len(header) + sz + len(footer)
+				if wait(ctx, filesLim, 1) != nil || wait(ctx, bytesLim, total) != nil {
+					population.Unpin(name)
+					return
+				}
+				population.Touch(name)
+				rewriteFile(name, sz, b, gen, header, footer, population)
+				continue
+			}
+		}
+
+		if wait(ctx, filesLim, 1) != nil {
+			return
+		}
+
 		_, err := crand.Read(fn)
 		if err != nil {
 			panic(err)
 		}
 
-		// read data
+		// fill payload
 		sz := mn + rand.Intn(mx-mn)
-		_, err = crand.Read(b[:sz])
-		if err != nil {
-			panic(err)
+		gen.Fill(b[:sz])
+		total := len(header) + sz + len(footer)
+		if wait(ctx, bytesLim, total) != nil {
+			return
 		}
 
 		// create file
-		fns := hex.EncodeToString(fn) + extension
+		fnHex := hex.EncodeToString(fn)
+		dir, err := layout.Dir(fnHex)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		fns := filepath.Join(dir, fnHex+extension)
 		//log.Printf("File named [%s] is %d bytes", fns, sz)
 		f, err := os.Create(fns)
 		if err != nil {
 			log.Print(err)
 		} else {
-			_, err = f.Write(b[:sz])
+			n, err := writePayload(f, header, b[:sz], footer)
 			if err != nil {
 				log.Print(err)
 			}
@@ -153,37 +347,183 @@ func writeFiles(mn, mx int, delay time.Duration, extension string) {
 			if err != nil {
 				log.Print(err)
 			}
-			kubismus.Metric("Data", 1, float64(sz))
+			randomizeMetadata(fns, modeMask, modeMin, mtimeSpread, preserveTime)
+			kubismus.Metric("Data", 1, float64(n))
+			kubismus.Metric("Files created", 1, float64(n))
+			if population != nil {
+				population.Add(fns, int64(n))
+			}
+		}
+	}
+}
+
+// wait blocks until the limiter has n tokens available, or ctx is
+// cancelled, and records an Overrun when the wait ran noticeably longer
+// than the limiter's configured rate would suggest.
+func wait(ctx context.Context, lim *rate.Limiter, n int) error {
+	start := time.Now()
+	err := lim.WaitN(ctx, n)
+	if err != nil {
+		return err
+	}
+	if limit := lim.Limit(); limit > 0 && limit != rate.Inf {
+		expected := time.Duration(float64(n) / float64(limit) * float64(time.Second))
+		if time.Since(start) > 2*expected {
+			kubismus.Metric("Overruns", 1, 0)
+		}
+	}
+	return nil
+}
+
+// writePayload writes header, body, and footer in sequence, returning the
+// total number of bytes written.
+func writePayload(f *os.File, header, body, footer []byte) (int, error) {
+	n := 0
+	for _, part := range [][]byte{header, body, footer} {
+		if len(part) == 0 {
+			continue
+		}
+		w, err := f.Write(part)
+		n += w
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// rewriteFile truncates and rewrites an existing file with fresh payload
+// content, exercising the modify-detection paths of sync/backup tools
+// instead of only their create paths. name must have been pinned via
+// population.PinRandom, which rewriteFile always clears on return so the
+// file becomes eligible for eviction again.
+func rewriteFile(name string, sz int, b []byte, gen content.Generator, header, footer []byte, population *Population) {
+	defer population.Unpin(name)
+
+	gen.Fill(b[:sz])
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	total, err := writePayload(f, header, b[:sz], footer)
+	if err != nil {
+		log.Print(err)
+	}
+	err = f.Close()
+	if err != nil {
+		log.Print(err)
+	}
+
+	population.Resize(name, int64(total))
+	kubismus.Metric("Rewrites", 1, float64(total))
+}
+
+// randomizeMetadata optionally scrambles the mode and mtime/atime of a
+// freshly written file, so tools built against real-world file trees
+// (sync clients, backup agents) don't just see defaults.
+func randomizeMetadata(name string, modeMask, modeMin os.FileMode, mtimeSpread time.Duration, preserveTime bool) {
+	if modeMask != 0 {
+		mode := os.FileMode(rand.Uint32())&modeMask | modeMin
+		err := os.Chmod(name, mode)
+		if err != nil {
+			log.Print(err)
+		} else {
+			fileMeta.recordMode(mode)
 		}
-		time.Sleep(delay)
+	}
+
+	if mtimeSpread != 0 {
+		mtime := time.Now().Add(-time.Duration(rand.Int63n(int64(mtimeSpread))))
+		atime := time.Now()
+		if !preserveTime {
+			atime = mtime
+		}
+		err := os.Chtimes(name, atime, mtime)
+		if err != nil {
+			log.Print(err)
+		} else {
+			fileMeta.recordMtime(mtime)
+		}
+	}
+}
+
+// metadataStats records the most recently randomized mode/mtime so they
+// can be surfaced on the periodic metrics tick rather than via a Note on
+// every single file write, which would flood the single-consumer
+// noteChan the way tree.go's per-directory Notes used to (see 054d71b).
+type metadataStats struct {
+	mu    sync.Mutex
+	mode  string
+	mtime string
+}
+
+func (s *metadataStats) recordMode(mode os.FileMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mode = mode.String()
+}
+
+func (s *metadataStats) recordMtime(mtime time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mtime = mtime.Format(time.RFC3339)
+}
+
+// Report publishes the last-seen mode/mtime through kubismus. It's meant
+// to be called periodically (e.g. from the metrics ticker) rather than on
+// every write.
+func (s *metadataStats) Report() {
+	s.mu.Lock()
+	mode, mtime := s.mode, s.mtime
+	s.mu.Unlock()
+	if mode != "" {
+		kubismus.Note("Last file mode", mode)
+	}
+	if mtime != "" {
+		kubismus.Note("Last file mtime", mtime)
 	}
 }
 
-func calcMetrics() {
+func calcMetrics(ctx context.Context) {
 	tck := time.NewTicker(time.Duration(10) * time.Second)
+	defer tck.Stop()
 	for {
 		select {
 		case <-tck.C:
-			kubismus.Note("Goroutines", fmt.Sprintf("%d", runtime.NumGoroutine()))
-			go func() {
-				v := kubismus.GetMetrics("Data", kubismus.SUM)
-				defer kubismus.ReleaseMetrics(v)
-				c := kubismus.GetMetrics("Data", kubismus.COUNT)
-				defer kubismus.ReleaseMetrics(c)
-				sz := len(c)
-				T := 0.0
-				C := 0.0
-				for i := sz - 60; i < sz; i++ {
-					C += c[i]
-					T += v[i]
-				}
-				A := 0.0
-				if C > 0.0 {
-					A = T / C
-				}
-				kubismus.Note("Last One Minute", fmt.Sprintf("%.0f Files, %.0f Average Size, %0.f Bytes", C, A, T))
-				log.Printf("Last one minute: %.0f Files, %.0f Average Size, %0.f Bytes", C, A, T)
-			}()
+			go reportMetrics()
+		case <-ctx.Done():
+			reportMetrics()
+			return
 		}
 	}
 }
+
+// reportMetrics logs and notes a summary of the last minute's activity;
+// it's called on every tick and once more on shutdown so the final
+// metrics are flushed.
+func reportMetrics() {
+	kubismus.Note("Goroutines", fmt.Sprintf("%d", runtime.NumGoroutine()))
+	if layout != nil {
+		layout.Report()
+	}
+	fileMeta.Report()
+	v := kubismus.GetMetrics("Data", kubismus.SUM)
+	defer kubismus.ReleaseMetrics(v)
+	c := kubismus.GetMetrics("Data", kubismus.COUNT)
+	defer kubismus.ReleaseMetrics(c)
+	sz := len(c)
+	T := 0.0
+	C := 0.0
+	for i := sz - 60; i < sz; i++ {
+		C += c[i]
+		T += v[i]
+	}
+	A := 0.0
+	if C > 0.0 {
+		A = T / C
+	}
+	kubismus.Note("Last One Minute", fmt.Sprintf("%.0f Files, %.0f Average Size, %0.f Bytes", C, A, T))
+	log.Printf("Last one minute: %.0f Files, %.0f Average Size, %0.f Bytes", C, A, T)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ancientlore/kubismus"
+)
+
+// Layout decides which subdirectory a generated file is placed under,
+// according to -treemode, -treedepth, -treefanout, and -treemaxperdir.
+// Flat directories don't scale on filesystems with per-directory limits,
+// so Layout spreads files across a generated tree instead.
+type Layout struct {
+	mode      string
+	depth     int
+	fanout    int
+	maxPerDir int
+
+	mu     sync.Mutex
+	counts map[string]int // files placed per leaf directory; not decremented when a file is later removed
+	gen    map[string]int // current sibling generation per base directory
+}
+
+// NewLayout creates a Layout for the given mode ("flat", "random",
+// "hashed", or "date"). A maxPerDir of 0 disables rebalancing. The mode
+// is validated up front so a typo fails fast at startup instead of
+// logging "tree: unknown mode" on every write for the life of the
+// process.
+func NewLayout(mode string, depth, fanout, maxPerDir int) (*Layout, error) {
+	switch mode {
+	case "", "flat", "random", "hashed", "date":
+	default:
+		return nil, fmt.Errorf("tree: unknown mode %q", mode)
+	}
+	return &Layout{
+		mode:      mode,
+		depth:     depth,
+		fanout:    fanout,
+		maxPerDir: maxPerDir,
+		counts:    make(map[string]int),
+		gen:       make(map[string]int),
+	}, nil
+}
+
+// Dir returns the directory, relative to the working directory, that the
+// file named fn should be created in. The directory (and any rebalanced
+// sibling) is created via os.MkdirAll before it's returned.
+func (t *Layout) Dir(fn string) (string, error) {
+	var parts []string
+	switch t.mode {
+	case "", "flat":
+		return ".", nil
+	case "random":
+		for i := 0; i < t.depth; i++ {
+			parts = append(parts, strconv.Itoa(rand.Intn(t.fanout)))
+		}
+	case "hashed":
+		// Like git's object store: use the leading bytes of the
+		// (already random) filename as directory components.
+		for i := 0; i < t.depth && i*2+2 <= len(fn); i++ {
+			parts = append(parts, fn[i*2:i*2+2])
+		}
+	case "date":
+		now := time.Now()
+		parts = []string{
+			fmt.Sprintf("%04d", now.Year()),
+			fmt.Sprintf("%02d", now.Month()),
+			fmt.Sprintf("%02d", now.Day()),
+			fmt.Sprintf("%02d", now.Hour()),
+		}
+	default:
+		return "", fmt.Errorf("tree: unknown mode %q", t.mode)
+	}
+
+	if len(parts) == 0 {
+		return ".", nil
+	}
+
+	dir := t.rebalance(filepath.Join(parts...))
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// rebalance returns the directory that a new file under base should land
+// in, bumping to a fresh sibling once maxPerDir is reached, and records
+// the placement for future calls and for reporting.
+func (t *Layout) rebalance(base string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dir := base
+	if g := t.gen[base]; g > 0 {
+		dir = fmt.Sprintf("%s~%d", base, g)
+	}
+
+	if t.maxPerDir > 0 && t.counts[dir] >= t.maxPerDir {
+		t.gen[base]++
+		dir = fmt.Sprintf("%s~%d", base, t.gen[base])
+	}
+
+	t.counts[dir]++
+	return dir
+}
+
+// Report publishes aggregate placement stats through kubismus. It's meant
+// to be called periodically (e.g. from the metrics ticker) rather than on
+// every write, since the number of distinct directories is unbounded in
+// "random" and "hashed" modes.
+func (t *Layout) Report() {
+	t.mu.Lock()
+	dirs := len(t.counts)
+	max := 0
+	for _, c := range t.counts {
+		if c > max {
+			max = c
+		}
+	}
+	t.mu.Unlock()
+	kubismus.Note("Tree directories", fmt.Sprintf("%d dirs, max %d files/dir", dirs, max))
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestLayoutRebalanceThreshold(t *testing.T) {
+	lay, err := NewLayout("random", 1, 4, 2)
+	if err != nil {
+		t.Fatalf("NewLayout: %v", err)
+	}
+
+	// The first two placements under "base" stay put; the third should
+	// spill into a fresh "~1" sibling.
+	if got := lay.rebalance("base"); got != "base" {
+		t.Fatalf("1st placement = %q, want %q", got, "base")
+	}
+	if got := lay.rebalance("base"); got != "base" {
+		t.Fatalf("2nd placement = %q, want %q", got, "base")
+	}
+	if got := lay.rebalance("base"); got != "base~1" {
+		t.Fatalf("3rd placement = %q, want %q", got, "base~1")
+	}
+
+	// Once bumped, later calls for the same base keep landing in the
+	// latest sibling until it too fills up.
+	if got := lay.rebalance("base"); got != "base~1" {
+		t.Fatalf("4th placement = %q, want %q", got, "base~1")
+	}
+	if got := lay.rebalance("base"); got != "base~2" {
+		t.Fatalf("5th placement = %q, want %q", got, "base~2")
+	}
+}
+
+func TestLayoutRebalanceDisabled(t *testing.T) {
+	lay, err := NewLayout("flat", 0, 16, 0)
+	if err != nil {
+		t.Fatalf("NewLayout: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if got := lay.rebalance("base"); got != "base" {
+			t.Fatalf("placement %d = %q, want %q (maxPerDir=0 disables rebalancing)", i, got, "base")
+		}
+	}
+}
+
+func TestNewLayoutUnknownMode(t *testing.T) {
+	if _, err := NewLayout("bogus", 1, 4, 0); err == nil {
+		t.Fatal("NewLayout with unknown mode: want error, got nil")
+	}
+}